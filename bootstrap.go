@@ -17,40 +17,45 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
-	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"time"
 
-	"golang.org/x/net/context/ctxhttp"
-
 	"github.com/scionproto/scion/go/bootstrapper/config"
+	"github.com/scionproto/scion/go/bootstrapper/discovery"
 	"github.com/scionproto/scion/go/bootstrapper/hinting"
+	"github.com/scionproto/scion/go/bootstrapper/trust"
 	"github.com/scionproto/scion/go/lib/common"
 	"github.com/scionproto/scion/go/lib/log"
 	"github.com/scionproto/scion/go/lib/topology"
 )
 
 const (
-	baseURL              = "scion/discovery/v1"
-	topologyEndpoint     = "/topology.json"
-	TRCsEndpoint         = "/trcs.tar"
 	TopologyJSONFileName = "topology.json"
-	httpRequestTimeout   = 2 * time.Second
-	hintsTimeout         = 10 * time.Second
+	// discoveryRequestTimeout bounds a whole discovery request, including
+	// the retries discovery.Client makes within it. It is larger than the
+	// old plain-HTTP timeout to leave room for a TLS handshake.
+	discoveryRequestTimeout = 5 * time.Second
+	hintsTimeout            = 10 * time.Second
 )
 
 type Bootstrapper struct {
-	cfg   *config.Config
-	iface *net.Interface
+	cfg             *config.Config
+	iface           *net.Interface
+	discoveryClient *discovery.Client
+	trustVerifier   *trust.Verifier
 	// ipHintsChan is used to inform the bootstrapper about discovered IP:port hints
-	ipHintsChan chan net.TCPAddr
+	ipHintsChan chan ipHint
+	// signedHintsChan carries hints from generators that can attest to
+	// their own authenticity (e.g. DHCPv6 with an Ed25519-signed option).
+	signedHintsChan chan signedIPHint
 }
 
 func NewBootstrapper(cfg *config.Config) (*Bootstrapper, error) {
@@ -59,106 +64,310 @@ func NewBootstrapper(cfg *config.Config) (*Bootstrapper, error) {
 	if err != nil {
 		return nil, common.NewBasicError(common.ErrMsg("getting interface by name: "+cfg.InterfaceName), err)
 	}
+	discoveryClient, err := discovery.NewClient(cfg.TLS)
+	if err != nil {
+		return nil, common.NewBasicError("building discovery client", err)
+	}
 	return &Bootstrapper{
 		cfg,
 		iface,
-		make(chan net.TCPAddr)}, nil
+		discoveryClient,
+		trust.NewVerifier(cfg.TrustAnchor),
+		make(chan ipHint),
+		make(chan signedIPHint)}, nil
+}
+
+// maxConcurrentHintProbes bounds how many hints are probed (topology fetch +
+// TRC fetch + verification) at the same time, so a flood of hint sources
+// cannot open unbounded outbound connections.
+const maxConcurrentHintProbes = 8
+
+// unverifiedHintDelay is how long an unverified signed hint (e.g. plain
+// DHCPv6 without a usable signature) waits before its probe is dispatched,
+// giving any verified hint racing it a head start.
+const unverifiedHintDelay = 200 * time.Millisecond
+
+// ipHint pairs a discovered address with the name of the generator that
+// produced it, so hint probes can be attributed to a source for debugging.
+type ipHint struct {
+	addr   net.TCPAddr
+	source string
+}
+
+// signedIPHint is the signed-generator equivalent of ipHint, pairing a
+// hinting.SignedHint with the name of the generator that produced it.
+type signedIPHint struct {
+	hint   hinting.SignedHint
+	source string
+}
+
+// hintOutcome is the result of probing a single hint: fetching its topology
+// and TRCs and fully verifying them.
+type hintOutcome struct {
+	addr     net.TCPAddr
+	source   string
+	latency  time.Duration
+	topology []byte
+	trcs     *verifiedTRCs
+	err      error
+}
+
+// verifiedTRCs holds the staged-but-not-yet-installed result of a
+// successful TRC fetch and verification for one hint.
+type verifiedTRCs struct {
+	stagingDir string
+	fileNames  []string
 }
 
 func (b *Bootstrapper) tryBootstrapping() error {
-	hintGenerators := []hinting.HintGenerator{
-		hinting.NewMockHintGenerator(&cfg.MOCK),
-		hinting.NewDHCPHintGenerator(&cfg.DHCP, b.iface),
+	hintGenerators := []struct {
+		source string
+		gen    hinting.HintGenerator
+	}{
+		{"mock", hinting.NewMockHintGenerator(&cfg.MOCK)},
+		{"dhcp", hinting.NewDHCPHintGenerator(&cfg.DHCP, b.iface)},
 		// XXX: DNS-SD depends on DNS resolution working, which can depend on DHCP for getting the local DNS resolver IP
-		hinting.NewDNSSDHintGenerator(&cfg.DNSSD),
+		{"dns-sd", hinting.NewDNSSDHintGenerator(&cfg.DNSSD, b.iface)},
 		// XXX: mDNS depends on the DNS search domain to be correct, which can depend on DHCP for getting it
-		hinting.NewMDNSHintGenerator(&cfg.MDNS, b.iface)}
+		{"mdns", hinting.NewMDNSHintGenerator(&cfg.MDNS, b.iface)},
+	}
 	for _, g := range hintGenerators {
+		rawChan := make(chan net.TCPAddr)
 		go func(g hinting.HintGenerator) {
 			defer log.HandlePanic()
-			g.Generate(b.ipHintsChan)
-		}(g)
+			g.Generate(rawChan)
+		}(g.gen)
+		go func(source string) {
+			for addr := range rawChan {
+				b.ipHintsChan <- ipHint{addr: addr, source: source}
+			}
+		}(g.source)
+	}
+
+	signedHintGenerators := []struct {
+		source string
+		gen    hinting.SignedHintGenerator
+	}{
+		{"dhcpv6", hinting.NewDHCPv6HintGenerator(&cfg.DHCPv6, b.iface)},
+	}
+	for _, g := range signedHintGenerators {
+		rawChan := make(chan hinting.SignedHint)
+		go func(g hinting.SignedHintGenerator) {
+			defer log.HandlePanic()
+			g.Generate(rawChan)
+		}(g.gen)
+		go func(source string) {
+			for hint := range rawChan {
+				b.signedHintsChan <- signedIPHint{hint: hint, source: source}
+			}
+		}(g.source)
 	}
-	hintsTimeout := time.After(hintsTimeout)
+	// RAHintGenerator only feeds DNS resolver/search-domain info, not hints,
+	// so it doesn't go through either hint-generator interface.
+	raGen := hinting.NewRAHintGenerator(&cfg.RA, b.iface)
+	go func() {
+		defer log.HandlePanic()
+		raGen.Generate()
+	}()
+
+	probeCtx, cancelProbes := context.WithCancel(context.Background())
+	defer cancelProbes()
+	sem := make(chan struct{}, maxConcurrentHintProbes)
+	resultsChan := make(chan hintOutcome)
+	seen := make(map[string]bool)
+	inFlight := 0
+
+	overallTimeout := time.After(hintsTimeout)
 	log.Info("Waiting for hints ...")
-OuterLoop:
 	for {
 		select {
-		case ipAddr := <-b.ipHintsChan:
-			serverAddr := &ipAddr
+		case hint := <-b.ipHintsChan:
+			serverAddr := hint.addr
+			if serverAddr.Port == 0 {
+				serverAddr.Port = int(hinting.DiscoveryPort)
+			}
+			key := serverAddr.String()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			inFlight++
+			b.dispatchHint(probeCtx, serverAddr, hint.source, 0, sem, resultsChan)
+		case signedHint := <-b.signedHintsChan:
+			serverAddr := signedHint.hint.Addr
 			if serverAddr.Port == 0 {
 				serverAddr.Port = int(hinting.DiscoveryPort)
 			}
-			err := pullTopology(serverAddr)
-			if err != nil {
-				return err
+			key := serverAddr.String()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			inFlight++
+			delay := time.Duration(0)
+			if !signedHint.hint.Verified {
+				// Heuristic, not a guarantee: give verified signed hints a
+				// head start over unverified ones (e.g. DHCPv6 without a
+				// valid signature), without refusing to ever use unverified
+				// hints when nothing else is available. Hints arriving on
+				// ipHintsChan are dispatched without this delay.
+				delay = unverifiedHintDelay
 			}
-			err = pullTRCs(serverAddr)
-			if err != nil {
-				return err
+			b.dispatchHint(probeCtx, serverAddr, signedHint.source, delay, sem, resultsChan)
+		case outcome := <-resultsChan:
+			inFlight--
+			log.Info("Hint probe done", "addr", outcome.addr, "source", outcome.source,
+				"latency", outcome.latency, "verified", outcome.err == nil, "err", outcome.err)
+			if outcome.err == nil {
+				cancelProbes()
+				return b.commitHint(outcome)
 			}
-			break OuterLoop
-		case <-hintsTimeout:
-			return fmt.Errorf("bootstrapper timed out")
+			if outcome.trcs != nil {
+				os.RemoveAll(outcome.trcs.stagingDir)
+			}
+		case <-overallTimeout:
+			return fmt.Errorf("bootstrapper timed out without a verified hint, %d probes still in flight", inFlight)
 		}
 	}
-	return nil
 }
 
-func pullTopology(addr *net.TCPAddr) error {
-	url := buildTopologyURL(addr.IP, addr.Port)
-	log.Info("Fetching topology", "url", url)
-	ctx, cancelF := context.WithTimeout(context.Background(), httpRequestTimeout)
-	defer cancelF()
-	r, err := fetchHTTP(ctx, url)
-	if err != nil {
-		log.Error("Failed to fetch topology from " + url, "err", err)
-		return err
-	}
-	defer func() {
-		if err := r.Close(); err != nil {
-			log.Error("Error closing the body of the topology response", "err", err)
+// dispatchHint schedules a probe of addr after delay, bounded by sem,
+// reporting its outcome on resultsChan. Every blocking step also selects on
+// ctx.Done(), so once tryBootstrapping commits to a winning hint and cancels
+// ctx, every other in-flight or still-queued probe goroutine exits instead
+// of leaking on a send that resultsChan's sole reader has stopped servicing.
+func (b *Bootstrapper) dispatchHint(
+	ctx context.Context, addr net.TCPAddr, source string, delay time.Duration,
+	sem chan struct{}, resultsChan chan<- hintOutcome,
+) {
+	go func() {
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-sem }()
+		outcome := b.probeHint(ctx, addr, source)
+		select {
+		case resultsChan <- outcome:
+		case <-ctx.Done():
 		}
 	}()
-	raw, err := ioutil.ReadAll(r)
-	if err != nil {
-		return common.NewBasicError("Unable to read from response body", err)
-	}
-	// Check that the topology is valid
-	_, err = topology.RWTopologyFromJSONBytes(raw)
+}
+
+// probeHint fetches and fully verifies the topology and TRCs served at addr,
+// without installing anything. The caller decides which of potentially
+// several concurrently probed hints to commit.
+func (b *Bootstrapper) probeHint(ctx context.Context, addr net.TCPAddr, source string) hintOutcome {
+	start := time.Now()
+	outcome := hintOutcome{addr: addr, source: source}
+	raw, rwTopo, err := b.fetchTopology(ctx, &addr)
 	if err != nil {
-		return common.NewBasicError("unable to parse RWTopology from JSON bytes", err)
+		outcome.err = err
+		outcome.latency = time.Since(start)
+		return outcome
 	}
+	outcome.topology = raw
+	trcs, err := b.fetchAndVerifyTRCs(ctx, &addr, rwTopo)
+	outcome.trcs = trcs
+	outcome.err = err
+	outcome.latency = time.Since(start)
+	return outcome
+}
+
+// commitHint installs the topology and TRCs from a successfully verified
+// hint outcome.
+func (b *Bootstrapper) commitHint(outcome hintOutcome) error {
 	topologyPath := path.Join(cfg.SciondConfigDir, TopologyJSONFileName)
-	err = ioutil.WriteFile(topologyPath, raw, 0644)
-	if err != nil {
+	if err := ioutil.WriteFile(topologyPath, outcome.topology, 0644); err != nil {
 		return common.NewBasicError("Bootstrapper could not store topology", err)
 	}
+	certsDir := path.Join(cfg.SciondConfigDir, "certs")
+	if err := os.MkdirAll(certsDir, 0755); err != nil {
+		return common.NewBasicError("creating certs directory", err)
+	}
+	defer os.RemoveAll(outcome.trcs.stagingDir)
+	for _, trcName := range outcome.trcs.fileNames {
+		src := path.Join(outcome.trcs.stagingDir, trcName)
+		dst := path.Join(certsDir, trcName)
+		if err := os.Rename(src, dst); err != nil {
+			return common.NewBasicError("Bootstrapper could not store verified TRC", err, "name", trcName)
+		}
+	}
+	log.Info("Committed verified hint", "addr", outcome.addr, "source", outcome.source)
 	return nil
 }
 
-func buildTopologyURL(ip net.IP, port int) string {
-	urlPath := baseURL + topologyEndpoint
-	return fmt.Sprintf("http://%s:%d/%s", ip, port, urlPath)
+func (b *Bootstrapper) fetchTopology(
+	ctx context.Context, addr *net.TCPAddr,
+) ([]byte, *topology.RWTopology, error) {
+	url := b.discoveryClient.TopologyURL(addr)
+	log.Info("Fetching topology", "url", url)
+	reqCtx, cancelF := context.WithTimeout(ctx, discoveryRequestTimeout)
+	defer cancelF()
+	raw, err := b.discoveryClient.Get(reqCtx, url)
+	if err != nil {
+		log.Error("Failed to fetch topology from "+url, "err", err)
+		return nil, nil, err
+	}
+	// Check that the topology is valid
+	rwTopo, err := topology.RWTopologyFromJSONBytes(raw)
+	if err != nil {
+		return nil, nil, common.NewBasicError("unable to parse RWTopology from JSON bytes", err)
+	}
+	return raw, rwTopo, nil
 }
 
-func pullTRCs(addr *net.TCPAddr) error {
-	url := buildTRCsURL(addr.IP, addr.Port)
+func (b *Bootstrapper) fetchAndVerifyTRCs(
+	ctx context.Context, addr *net.TCPAddr, rwTopo *topology.RWTopology,
+) (*verifiedTRCs, error) {
+	url := b.discoveryClient.TRCsURL(addr)
 	log.Info("Fetching TRCs", "url", url)
-	ctx, cancelF := context.WithTimeout(context.Background(), httpRequestTimeout)
+	reqCtx, cancelF := context.WithTimeout(ctx, discoveryRequestTimeout)
 	defer cancelF()
-	r, err := fetchHTTP(ctx, url)
+	raw, err := b.discoveryClient.Get(reqCtx, url)
 	if err != nil {
-		log.Error("Failed to fetch TRC from " + url, "err", err)
-		return err
+		log.Error("Failed to fetch TRC from "+url, "err", err)
+		return nil, err
 	}
-	// Close response reader and handle errors
-	defer func() {
-		if err := r.Close(); err != nil {
-			log.Error("Error closing the body of the TRCs response", "err", err)
+	// Extract the TRCs tar archive into a scratch directory first: nothing
+	// is moved into cfg.SciondConfigDir/certs until the chain verifies, so a
+	// malicious or buggy discovery server can't overwrite trusted TRCs with
+	// a failed verification attempt.
+	stagingDir, err := ioutil.TempDir(cfg.SciondConfigDir, "trcs-staging-")
+	if err != nil {
+		return nil, common.NewBasicError("creating TRC staging directory", err)
+	}
+	trcNames, err := extractTRCs(bytes.NewReader(raw), stagingDir)
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return nil, err
+	}
+	trcs := &verifiedTRCs{stagingDir: stagingDir, fileNames: trcNames}
+
+	validated, err := b.trustVerifier.VerifyTRCs(stagingDir)
+	if err != nil {
+		return trcs, common.NewBasicError("TRC chain verification failed", err)
+	}
+	if rwTopo != nil {
+		if err := trust.VerifyTopologyIA(rwTopo.IA, validated); err != nil {
+			return trcs, err
 		}
-	}()
-	// Extract TRCs tar archive
+	}
+	return trcs, nil
+}
+
+// extractTRCs extracts the TRCs tar archive read from r into dir, returning
+// the base names of the extracted files.
+func extractTRCs(r io.Reader, dir string) ([]string, error) {
+	var trcNames []string
 	tr := tar.NewReader(r)
 	for {
 		hdr, err := tr.Next()
@@ -166,7 +375,7 @@ func pullTRCs(addr *net.TCPAddr) error {
 			break
 		}
 		if err != nil {
-			return common.NewBasicError("error reading tar archive", err)
+			return nil, common.NewBasicError("error reading tar archive", err)
 		}
 		switch hdr.Typeflag {
 		case tar.TypeReg:
@@ -175,19 +384,20 @@ func pullTRCs(addr *net.TCPAddr) error {
 				log.Error("Invalid TRC file name", "name", hdr.Name)
 				continue
 			}
-			trcPath := path.Join(cfg.SciondConfigDir, "certs", trcName)
+			trcPath := path.Join(dir, trcName)
 			log.Info("Extracting TRC", "name", trcName, "destination", trcPath)
 			if err := writeTarEntry(trcPath, tr); err != nil {
-				return common.NewBasicError("Bootstrapper could not store TRC", err)
+				return nil, common.NewBasicError("Bootstrapper could not store TRC", err)
 			}
+			trcNames = append(trcNames, trcName)
 		case tar.TypeDir:
-			return fmt.Errorf("TRCs archive must be composed of TRCs only, directory found")
+			return nil, fmt.Errorf("TRCs archive must be composed of TRCs only, directory found")
 		default:
-			return fmt.Errorf("TRCs archive must be composed of TRCs only"+
+			return nil, fmt.Errorf("TRCs archive must be composed of TRCs only"+
 				", unknown type found: %c", hdr.Typeflag)
 		}
 	}
-	return nil
+	return trcNames, nil
 }
 
 func writeTarEntry(trcPath string, tr *tar.Reader) error {
@@ -203,21 +413,3 @@ func writeTarEntry(trcPath string, tr *tar.Reader) error {
 	return nil
 }
 
-func buildTRCsURL(ip net.IP, port int) string {
-	urlPath := baseURL + TRCsEndpoint
-	return fmt.Sprintf("http://%s:%d/%s", ip, port, urlPath)
-}
-
-func fetchHTTP(ctx context.Context, url string) (io.ReadCloser, error) {
-	res, err := ctxhttp.Get(ctx, nil, url)
-	if err != nil {
-		return nil, common.NewBasicError("HTTP request failed", err)
-	}
-	if res.StatusCode != http.StatusOK {
-		if err != res.Body.Close() {
-			log.Error("Error closing response body", "err", err)
-		}
-		return nil, common.NewBasicError("Status not OK", nil, "status", res.Status)
-	}
-	return res.Body, nil
-}
@@ -0,0 +1,183 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery implements the HTTP(S) client used to fetch the
+// topology and TRCs from a discovery server found via hinting.
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/scionproto/scion/go/bootstrapper/internal/spkipin"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/log"
+)
+
+const (
+	baseURL          = "scion/discovery/v1"
+	topologyEndpoint = "/topology.json"
+	trcsEndpoint     = "/trcs.tar"
+
+	maxRetries     = 3
+	initialBackoff = 250 * time.Millisecond
+)
+
+// ClientConf configures the TLS behavior of the discovery Client. An empty
+// ClientConf (all fields unset) causes the Client to fall back to plain
+// http://, preserving the pre-TLS bootstrap behavior on networks where
+// operators have not yet provisioned trust material.
+type ClientConf struct {
+	// Enable selects https:// discovery endpoints instead of http://.
+	Enable bool `toml:"enable"`
+	// CAFile is a PEM bundle of CAs trusted to sign the discovery server's
+	// certificate, in addition to (or instead of) the system roots.
+	CAFile string `toml:"ca_file"`
+	// DisableSystemRootCAs, if true, trusts only CAFile and SPKIPins, not the
+	// host's system root CA pool.
+	DisableSystemRootCAs bool `toml:"disable_system_root_cas"`
+	// SPKIPins is a list of hex-encoded SHA-256 SPKI fingerprints. When
+	// non-empty, the discovery server's certificate must match one of these
+	// pins, e.g. because it was learned insecurely via DHCP/DNS.
+	SPKIPins []string `toml:"spki_pins"`
+	// ClientCertFile/ClientKeyFile enable mTLS for deployments where the
+	// operator pre-provisions a device certificate.
+	ClientCertFile string `toml:"client_cert_file"`
+	ClientKeyFile  string `toml:"client_key_file"`
+}
+
+// Client fetches the topology and TRCs from a discovery server, selecting
+// http:// or https:// based on its ClientConf.
+type Client struct {
+	cfg        ClientConf
+	httpClient *http.Client
+}
+
+// NewClient builds a Client from cfg. An error is returned if the TLS trust
+// material in cfg cannot be loaded.
+func NewClient(cfg ClientConf) (*Client, error) {
+	httpClient := &http.Client{}
+	if cfg.Enable {
+		tlsConfig, err := buildTLSConfig(cfg)
+		if err != nil {
+			return nil, common.NewBasicError("building discovery TLS config", err)
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return &Client{cfg: cfg, httpClient: httpClient}, nil
+}
+
+func buildTLSConfig(cfg ClientConf) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if cfg.DisableSystemRootCAs || cfg.CAFile != "" {
+		pool := x509.NewCertPool()
+		if !cfg.DisableSystemRootCAs {
+			systemPool, err := x509.SystemCertPool()
+			if err != nil {
+				return nil, common.NewBasicError("loading system cert pool", err)
+			}
+			pool = systemPool
+		}
+		if cfg.CAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, common.NewBasicError("reading CA bundle", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, common.NewBasicError("no certificates found in CA bundle", nil, "file", cfg.CAFile)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(cfg.SPKIPins) > 0 {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = spkipin.Verify(cfg.SPKIPins)
+	}
+	if cfg.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, common.NewBasicError("loading client certificate", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (c *Client) scheme() string {
+	if c.cfg.Enable {
+		return "https"
+	}
+	return "http"
+}
+
+// TopologyURL builds the URL to fetch the topology from addr.
+func (c *Client) TopologyURL(addr *net.TCPAddr) string {
+	return fmt.Sprintf("%s://%s:%d/%s", c.scheme(), addr.IP, addr.Port, baseURL+topologyEndpoint)
+}
+
+// TRCsURL builds the URL to fetch the TRCs archive from addr.
+func (c *Client) TRCsURL(addr *net.TCPAddr) string {
+	return fmt.Sprintf("%s://%s:%d/%s", c.scheme(), addr.IP, addr.Port, baseURL+trcsEndpoint)
+}
+
+// Get performs an HTTP(S) GET of url and returns the response body,
+// retrying with exponential backoff on failure since a TLS handshake can
+// comfortably exceed a single short request timeout.
+func (c *Client) Get(ctx context.Context, url string) ([]byte, error) {
+	backoff := initialBackoff
+	var lastErr error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			log.Info("Retrying discovery request", "url", url, "attempt", attempt)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+		body, err := c.get(ctx, url)
+		if err == nil {
+			return body, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (c *Client) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, common.NewBasicError("building discovery request", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, common.NewBasicError("discovery request failed", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, common.NewBasicError("discovery request status not OK", nil, "status", res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, common.NewBasicError("reading discovery response body", err)
+	}
+	return body, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package addrselect implements destination address ordering as described
+// in RFC 6724 ("Default Address Selection for Internet Protocol Version 6").
+// On dual-stack hosts, a plain arrival-order emission of DNS hints
+// frequently hands the bootstrapper an IPv6 address that is unreachable
+// from the local interface; sorting candidates the way the RFC prescribes
+// picks one the host can actually use first.
+package addrselect
+
+import (
+	"net"
+	"sort"
+)
+
+// PolicyTableEntry is one row of the RFC 6724 section 2.1 policy table,
+// associating a source/destination prefix with a precedence (used for
+// sorting, rule 6) and a label (RFC 6724 rule 5; Sort does not use it).
+type PolicyTableEntry struct {
+	Prefix     net.IPNet
+	Precedence int
+	Label      int
+}
+
+// PolicyTable is an ordered list of PolicyTableEntry, matched most-specific
+// prefix first.
+type PolicyTable []PolicyTableEntry
+
+// classify returns the precedence and label of the entry in t whose prefix
+// is the longest match for ip, per RFC 6724 section 2.1.
+func (t PolicyTable) classify(ip net.IP) (precedence, label int) {
+	var best *PolicyTableEntry
+	bestLen := -1
+	for i := range t {
+		entry := &t[i]
+		if !entry.Prefix.Contains(ip) {
+			continue
+		}
+		ones, _ := entry.Prefix.Mask.Size()
+		if ones > bestLen {
+			bestLen = ones
+			best = entry
+		}
+	}
+	if best == nil {
+		return 1, 1
+	}
+	return best.Precedence, best.Label
+}
+
+func mustParseCIDR(s string) net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return *n
+}
+
+// DefaultPolicyTable is the table given as the default in RFC 6724
+// section 2.1.
+var DefaultPolicyTable = PolicyTable{
+	{Prefix: mustParseCIDR("::1/128"), Precedence: 50, Label: 0},
+	{Prefix: mustParseCIDR("::/0"), Precedence: 40, Label: 1},
+	{Prefix: mustParseCIDR("::ffff:0:0/96"), Precedence: 35, Label: 4},
+	{Prefix: mustParseCIDR("2002::/16"), Precedence: 30, Label: 2},
+	{Prefix: mustParseCIDR("2001::/32"), Precedence: 5, Label: 5},
+	{Prefix: mustParseCIDR("fc00::/7"), Precedence: 3, Label: 13},
+	{Prefix: mustParseCIDR("::/96"), Precedence: 1, Label: 3},
+	{Prefix: mustParseCIDR("fec0::/10"), Precedence: 1, Label: 11},
+	{Prefix: mustParseCIDR("3ffe::/16"), Precedence: 1, Label: 12},
+}
+
+// IPv4PreferredPolicyTable is DefaultPolicyTable with IPv4's precedence
+// raised above IPv6, for operators who want to push IPv4 first regardless
+// of the destination's scope.
+var IPv4PreferredPolicyTable = PolicyTable{
+	{Prefix: mustParseCIDR("::1/128"), Precedence: 50, Label: 0},
+	{Prefix: mustParseCIDR("::ffff:0:0/96"), Precedence: 45, Label: 4},
+	{Prefix: mustParseCIDR("::/0"), Precedence: 40, Label: 1},
+	{Prefix: mustParseCIDR("2002::/16"), Precedence: 30, Label: 2},
+	{Prefix: mustParseCIDR("2001::/32"), Precedence: 5, Label: 5},
+	{Prefix: mustParseCIDR("fc00::/7"), Precedence: 3, Label: 13},
+	{Prefix: mustParseCIDR("::/96"), Precedence: 1, Label: 3},
+	{Prefix: mustParseCIDR("fec0::/10"), Precedence: 1, Label: 11},
+	{Prefix: mustParseCIDR("3ffe::/16"), Precedence: 1, Label: 12},
+}
+
+func scope(ip net.IP) int {
+	switch {
+	case ip.IsLoopback():
+		return 0x2
+	case ip.IsLinkLocalUnicast():
+		return 0x2
+	case ip.IsLinkLocalMulticast():
+		return 0x2
+	case ip.To4() != nil:
+		// Any other IPv4 address (including 4-in-6) is treated as having
+		// global scope, matching the common Unix getaddrinfo() implementations RFC 6724
+		// is modeled on.
+		return 0xe
+	default:
+		return 0xe // global
+	}
+}
+
+func commonPrefixLen(a, b net.IP) int {
+	a16, b16 := a.To16(), b.To16()
+	if a16 == nil || b16 == nil {
+		return 0
+	}
+	n := 0
+	for i := 0; i < len(a16); i++ {
+		xor := a16[i] ^ b16[i]
+		if xor == 0 {
+			n += 8
+			continue
+		}
+		for mask := byte(0x80); mask != 0 && xor&mask == 0; mask >>= 1 {
+			n++
+		}
+		break
+	}
+	return n
+}
+
+// Candidate is one destination address to be ordered, together with the
+// best source address the local interface has for reaching it (as chosen
+// by ChooseSourceAddr).
+type Candidate struct {
+	Dst net.IP
+	Src net.IP
+}
+
+// ChooseSourceAddr picks, among ifaceAddrs, the address RFC 6724 would use
+// as the source for reaching dst: prefer an address of the same address
+// family, then the one with the longest matching prefix. It returns false
+// if ifaceAddrs has no address of dst's family.
+func ChooseSourceAddr(dst net.IP, ifaceAddrs []net.IP) (net.IP, bool) {
+	var best net.IP
+	bestLen := -1
+	dstIs4 := dst.To4() != nil
+	for _, src := range ifaceAddrs {
+		if (src.To4() != nil) != dstIs4 {
+			continue
+		}
+		l := commonPrefixLen(src, dst)
+		if l > bestLen {
+			bestLen = l
+			best = src
+		}
+	}
+	return best, best != nil
+}
+
+// Sort orders candidates by RFC 6724 destination address selection rules,
+// best first: matching scope (rule 2), policy table precedence (rule 6),
+// and longest matching prefix between source and destination (rule 9). The
+// other RFC 6724 rules either don't apply to this use case (no transport
+// protocol/label preferences exposed to the bootstrapper) or require host
+// routing-table information this package does not have.
+func Sort(candidates []Candidate, table PolicyTable) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return less(candidates[i], candidates[j], table)
+	})
+}
+
+func less(a, b Candidate, table PolicyTable) bool {
+	// A nil Src means ChooseSourceAddr found no usable local address for
+	// that family at all (e.g. an AAAA hint on a host with no IPv6
+	// connectivity): it always sorts after a candidate with a usable
+	// source, regardless of policy table precedence.
+	aUsable, bUsable := a.Src != nil, b.Src != nil
+	if aUsable != bUsable {
+		return aUsable
+	}
+	// Rule 2: Prefer matching scope.
+	if aUsable {
+		asc, bsc := scope(a.Dst), scope(b.Dst)
+		srcASc, srcBSc := scope(a.Src), scope(b.Src)
+		aMatches := asc == srcASc
+		bMatches := bsc == srcBSc
+		if aMatches != bMatches {
+			return aMatches
+		}
+	}
+	// Rule 6: Prefer higher precedence.
+	aPrec, _ := table.classify(a.Dst)
+	bPrec, _ := table.classify(b.Dst)
+	if aPrec != bPrec {
+		return aPrec > bPrec
+	}
+	// Rule 9: Prefer the longest matching source/destination prefix.
+	if a.Src != nil && b.Src != nil {
+		aLen := commonPrefixLen(a.Src, a.Dst)
+		bLen := commonPrefixLen(b.Src, b.Dst)
+		if aLen != bLen {
+			return aLen > bLen
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addrselect_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/scionproto/scion/go/bootstrapper/hinting/addrselect"
+)
+
+func TestChooseSourceAddr(t *testing.T) {
+	ifaceAddrs := []net.IP{
+		net.ParseIP("198.51.100.1"),
+		net.ParseIP("2001:db8::1"),
+	}
+	testCases := map[string]struct {
+		dst     string
+		wantSrc string
+		wantOK  bool
+	}{
+		"ipv4 dest picks ipv4 source": {
+			dst: "198.51.100.53", wantSrc: "198.51.100.1", wantOK: true,
+		},
+		"ipv6 dest picks ipv6 source": {
+			dst: "2001:db8::53", wantSrc: "2001:db8::1", wantOK: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			src, ok := addrselect.ChooseSourceAddr(net.ParseIP(tc.dst), ifaceAddrs)
+			assert.Equal(t, tc.wantOK, ok)
+			if tc.wantOK {
+				assert.Equal(t, net.ParseIP(tc.wantSrc), src)
+			}
+		})
+	}
+}
+
+// TestSortPrefersMatchingScope covers RFC 6724 rule 2: with only a global
+// IPv6 source address, a global destination (whose scope matches the
+// source) sorts before a link-local one (whose scope does not).
+func TestSortPrefersMatchingScope(t *testing.T) {
+	src := net.ParseIP("2001:db8::1")
+	global := net.ParseIP("2001:db8::53")
+	linkLocal := net.ParseIP("fe80::53")
+	candidates := []addrselect.Candidate{
+		{Dst: linkLocal, Src: src},
+		{Dst: global, Src: src},
+	}
+	addrselect.Sort(candidates, addrselect.DefaultPolicyTable)
+	assert.True(t, candidates[0].Dst.Equal(global), "global scope destination should sort first")
+}
+
+// TestSortPrefersHigherPrecedence covers RFC 6724 section 10.3: with the
+// default policy table, native IPv6 (label 1) outranks 6to4 (label 2).
+func TestSortPrefersHigherPrecedence(t *testing.T) {
+	src := net.ParseIP("2001:db8::1")
+	native := net.ParseIP("2001:db8::53")
+	sixToFour := net.ParseIP("2002:c000:201::53")
+	candidates := []addrselect.Candidate{
+		{Dst: sixToFour, Src: src},
+		{Dst: native, Src: src},
+	}
+	addrselect.Sort(candidates, addrselect.DefaultPolicyTable)
+	assert.True(t, candidates[0].Dst.Equal(native), "native transport should outrank 6to4")
+}
+
+func TestSortPrefersLongestMatchingPrefix(t *testing.T) {
+	src := net.ParseIP("2001:db8:1::1")
+	closer := net.ParseIP("2001:db8:1::53")
+	farther := net.ParseIP("2001:db8:2::53")
+	candidates := []addrselect.Candidate{
+		{Dst: farther, Src: src},
+		{Dst: closer, Src: src},
+	}
+	addrselect.Sort(candidates, addrselect.DefaultPolicyTable)
+	assert.True(t, candidates[0].Dst.Equal(closer), "longer matching prefix should sort first")
+}
+
+// TestSortPrefersReachableOverUnreachable covers a host with no IPv6
+// connectivity (Src == nil for the AAAA hint): even though the default
+// policy table ranks native IPv6 above IPv4, an unreachable destination
+// must never sort ahead of one the host can actually use.
+func TestSortPrefersReachableOverUnreachable(t *testing.T) {
+	v4 := net.ParseIP("198.51.100.53")
+	v6 := net.ParseIP("2001:db8::53")
+	candidates := []addrselect.Candidate{
+		{Dst: v6, Src: nil},
+		{Dst: v4, Src: net.ParseIP("198.51.100.1")},
+	}
+	addrselect.Sort(candidates, addrselect.DefaultPolicyTable)
+	assert.True(t, candidates[0].Dst.Equal(v4),
+		"unreachable destination (nil Src) must sort after a reachable one")
+}
+
+func TestIPv4PreferredPolicyTable(t *testing.T) {
+	src4 := net.ParseIP("198.51.100.1")
+	v4 := net.ParseIP("198.51.100.53")
+	v6 := net.ParseIP("2001:db8::53")
+	candidates := []addrselect.Candidate{
+		{Dst: v6, Src: net.ParseIP("2001:db8::1")},
+		{Dst: v4, Src: src4},
+	}
+	addrselect.Sort(candidates, addrselect.IPv4PreferredPolicyTable)
+	assert.True(t, candidates[0].Dst.Equal(v4), "IPv4-preferred table should rank IPv4 first")
+}
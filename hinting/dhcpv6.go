@@ -0,0 +1,273 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hinting
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/log"
+)
+
+const (
+	dhcpv6AllServersMulticast = "ff02::1:2"
+	dhcpv6ServerPort          = 547
+	dhcpv6ClientPort          = 546
+
+	dhcpv6MsgInformationRequest = 11
+	dhcpv6MsgReply              = 7
+
+	dhcpv6OptElapsedTime = 8
+	dhcpv6OptORO         = 6
+	dhcpv6OptVendorOpts  = 17
+
+	// dhcpv6DiscoveryEnterpriseNumber and dhcpv6DiscoverySubOption identify
+	// the vendor-specific sub-option carrying the signed discovery server
+	// hint. The enterprise number is a placeholder pending IANA allocation.
+	dhcpv6DiscoveryEnterpriseNumber = 55324
+	dhcpv6DiscoverySubOption        = 1
+
+	dhcpv6RequestTimeout = 5 * time.Second
+
+	// dhcpv6SignatureFreshnessWindow bounds how old a signed discovery
+	// payload's timestamp may be. Without this, a captured signed reply
+	// could be replayed by an on-link attacker indefinitely, long after the
+	// legitimate discovery server is gone or its key rotated.
+	dhcpv6SignatureFreshnessWindow = 5 * time.Minute
+)
+
+// DHCPv6HintGeneratorConf configures the DHCPv6 hint generator.
+type DHCPv6HintGeneratorConf struct {
+	Enable bool `toml:"enable"`
+	// PublicKey is the hex-encoded Ed25519 public key used to verify the
+	// signature carried in the vendor-specific discovery option. If empty,
+	// hints are still emitted, but always marked unverified.
+	PublicKey string `toml:"public_key"`
+}
+
+var _ SignedHintGenerator = (*DHCPv6HintGenerator)(nil)
+
+// DHCPv6HintGenerator requests a discovery server hint via a DHCPv6
+// INFORMATION-REQUEST, reading it from a vendor-specific option carrying the
+// discovery server FQDN and an optional Ed25519 signature over
+// (FQDN, timestamp, nonce). This closes the spoofed-DHCP hole on
+// IPv6-only/SLAAC-only networks that DHCPv4 option hinting cannot reach.
+type DHCPv6HintGenerator struct {
+	cfg   *DHCPv6HintGeneratorConf
+	iface *net.Interface
+}
+
+func NewDHCPv6HintGenerator(cfg *DHCPv6HintGeneratorConf, iface *net.Interface) *DHCPv6HintGenerator {
+	return &DHCPv6HintGenerator{cfg, iface}
+}
+
+func (g *DHCPv6HintGenerator) Generate(signedHintsChan chan<- SignedHint) {
+	if !g.cfg.Enable {
+		return
+	}
+	payload, err := g.requestDiscoveryOption()
+	if err != nil {
+		log.Error("DHCPv6 hinting failed", "err", err)
+		return
+	}
+	verified := g.verify(payload)
+	ips, err := net.LookupIP(payload.fqdn)
+	if err != nil {
+		log.Error("DHCPv6 hint FQDN did not resolve", "fqdn", payload.fqdn, "err", err)
+		return
+	}
+	for _, ip := range ips {
+		addr := net.TCPAddr{IP: ip, Port: int(DiscoveryPort)}
+		log.Info("DHCPv6 hint", "addr", addr, "verified", verified)
+		signedHintsChan <- SignedHint{Addr: addr, Verified: verified}
+	}
+}
+
+// dhcpv6DiscoveryPayload is the decoded content of the vendor-specific
+// discovery sub-option: the discovery server FQDN plus an optional
+// signature over (FQDN, timestamp, nonce).
+type dhcpv6DiscoveryPayload struct {
+	fqdn      string
+	timestamp uint64
+	nonce     [8]byte
+	signature []byte
+}
+
+func (g *DHCPv6HintGenerator) verify(p *dhcpv6DiscoveryPayload) bool {
+	if g.cfg.PublicKey == "" || len(p.signature) == 0 {
+		return false
+	}
+	pubKey, err := hex.DecodeString(g.cfg.PublicKey)
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		log.Error("Invalid DHCPv6 verification public key", "err", err)
+		return false
+	}
+	signed := signedDHCPv6Message(p.fqdn, p.timestamp, p.nonce)
+	if !ed25519.Verify(pubKey, signed, p.signature) {
+		return false
+	}
+	age := time.Since(time.Unix(int64(p.timestamp), 0))
+	if age < 0 || age > dhcpv6SignatureFreshnessWindow {
+		log.Error("DHCPv6 signed hint timestamp outside freshness window, possible replay",
+			"age", age, "window", dhcpv6SignatureFreshnessWindow)
+		return false
+	}
+	return true
+}
+
+func signedDHCPv6Message(fqdn string, timestamp uint64, nonce [8]byte) []byte {
+	buf := make([]byte, 0, len(fqdn)+8+len(nonce))
+	buf = append(buf, fqdn...)
+	var tsBuf [8]byte
+	binary.BigEndian.PutUint64(tsBuf[:], timestamp)
+	buf = append(buf, tsBuf[:]...)
+	buf = append(buf, nonce[:]...)
+	return buf
+}
+
+// requestDiscoveryOption performs a single DHCPv6 INFORMATION-REQUEST /
+// REPLY exchange over g.iface and returns the decoded discovery option from
+// the reply's vendor-specific option.
+func (g *DHCPv6HintGenerator) requestDiscoveryOption() (*dhcpv6DiscoveryPayload, error) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{Port: dhcpv6ClientPort, Zone: g.iface.Name})
+	if err != nil {
+		return nil, common.NewBasicError("opening DHCPv6 socket", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(dhcpv6RequestTimeout)); err != nil {
+		return nil, common.NewBasicError("setting DHCPv6 socket deadline", err)
+	}
+
+	dst := &net.UDPAddr{
+		IP:   net.ParseIP(dhcpv6AllServersMulticast),
+		Port: dhcpv6ServerPort,
+		Zone: g.iface.Name,
+	}
+	req := buildInformationRequest()
+	if _, err := conn.WriteToUDP(req, dst); err != nil {
+		return nil, common.NewBasicError("sending DHCPv6 INFORMATION-REQUEST", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, common.NewBasicError("reading DHCPv6 reply", err)
+		}
+		payload, ok, err := parseReply(buf[:n])
+		if err != nil {
+			log.Error("Ignoring malformed DHCPv6 reply", "err", err)
+			continue
+		}
+		if ok {
+			return payload, nil
+		}
+	}
+}
+
+func buildInformationRequest() []byte {
+	msg := []byte{dhcpv6MsgInformationRequest, 0, 0, 0}
+	// OPTION_ELAPSED_TIME: required by RFC 8415 section 21.9.
+	msg = appendOption(msg, dhcpv6OptElapsedTime, []byte{0, 0})
+	// OPTION_ORO: ask for the vendor-specific option carrying our hint.
+	oro := make([]byte, 2)
+	binary.BigEndian.PutUint16(oro, dhcpv6OptVendorOpts)
+	msg = appendOption(msg, dhcpv6OptORO, oro)
+	return msg
+}
+
+func appendOption(msg []byte, code uint16, data []byte) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header[0:2], code)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(data)))
+	msg = append(msg, header...)
+	return append(msg, data...)
+}
+
+// parseReply parses a DHCPv6 message, returning the decoded discovery
+// payload and true if msg is a REPLY carrying our vendor-specific option.
+func parseReply(msg []byte) (*dhcpv6DiscoveryPayload, bool, error) {
+	if len(msg) < 4 || msg[0] != dhcpv6MsgReply {
+		return nil, false, nil
+	}
+	options := msg[4:]
+	for len(options) >= 4 {
+		code := binary.BigEndian.Uint16(options[0:2])
+		length := binary.BigEndian.Uint16(options[2:4])
+		if len(options) < int(4+length) {
+			return nil, false, errors.New("truncated DHCPv6 option")
+		}
+		data := options[4 : 4+length]
+		if code == dhcpv6OptVendorOpts {
+			payload, err := parseVendorOption(data)
+			if err != nil {
+				return nil, false, err
+			}
+			if payload != nil {
+				return payload, true, nil
+			}
+		}
+		options = options[4+length:]
+	}
+	return nil, false, nil
+}
+
+func parseVendorOption(data []byte) (*dhcpv6DiscoveryPayload, error) {
+	if len(data) < 4 {
+		return nil, errors.New("truncated vendor-specific option")
+	}
+	if binary.BigEndian.Uint32(data[0:4]) != dhcpv6DiscoveryEnterpriseNumber {
+		return nil, nil
+	}
+	subOptions := data[4:]
+	for len(subOptions) >= 4 {
+		code := binary.BigEndian.Uint16(subOptions[0:2])
+		length := binary.BigEndian.Uint16(subOptions[2:4])
+		if len(subOptions) < int(4+length) {
+			return nil, errors.New("truncated vendor sub-option")
+		}
+		sub := subOptions[4 : 4+length]
+		if code == dhcpv6DiscoverySubOption {
+			return decodeDiscoveryPayload(sub)
+		}
+		subOptions = subOptions[4+length:]
+	}
+	return nil, nil
+}
+
+// decodeDiscoveryPayload decodes: 2-byte FQDN length, FQDN, 8-byte
+// timestamp, 8-byte nonce, remaining bytes (if any) as an Ed25519
+// signature.
+func decodeDiscoveryPayload(data []byte) (*dhcpv6DiscoveryPayload, error) {
+	if len(data) < 2 {
+		return nil, errors.New("truncated discovery payload")
+	}
+	fqdnLen := int(binary.BigEndian.Uint16(data[0:2]))
+	data = data[2:]
+	if len(data) < fqdnLen+16 {
+		return nil, errors.New("truncated discovery payload")
+	}
+	payload := &dhcpv6DiscoveryPayload{fqdn: string(data[:fqdnLen])}
+	data = data[fqdnLen:]
+	payload.timestamp = binary.BigEndian.Uint64(data[:8])
+	copy(payload.nonce[:], data[8:16])
+	payload.signature = append([]byte(nil), data[16:]...)
+	return payload, nil
+}
@@ -15,15 +15,25 @@
 package hinting
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 
+	"github.com/scionproto/scion/go/bootstrapper/hinting/addrselect"
+	"github.com/scionproto/scion/go/bootstrapper/internal/spkipin"
 	"github.com/scionproto/scion/go/lib/common"
 	"github.com/scionproto/scion/go/lib/log"
 )
@@ -31,6 +41,21 @@ import (
 const (
 	discoveryServiceDNSName string = "_sciondiscovery._tcp"
 	discoveryDDDSDNSName    string = "x-sciondiscovery:tcp"
+
+	// resolverProtoUDP is the default, plaintext DNS over UDP.
+	resolverProtoUDP string = "udp"
+	// resolverProtoTCP is plaintext DNS over TCP.
+	resolverProtoTCP string = "tcp"
+	// resolverProtoTLS is DNS-over-TLS (RFC 7858).
+	resolverProtoTLS string = "tls"
+	// resolverProtoHTTPS is DNS-over-HTTPS (RFC 8484).
+	resolverProtoHTTPS string = "https"
+	// resolverProtoQUIC is DNS-over-QUIC (RFC 9250).
+	resolverProtoQUIC string = "quic"
+
+	dohMediaType    = "application/dns-message"
+	doqALPN         = "doq"
+	doqQueryTimeout = 4 * time.Second
 )
 
 var (
@@ -41,17 +66,67 @@ type DNSHintGeneratorConf struct {
 	EnableSD    bool `toml:"enable_sd"`
 	EnableNAPTR bool `toml:"enable_naptr"`
 	EnableSRV   bool `toml:"enable_srv"`
+	// ResolverProtocols lists the transport protocols to try for each
+	// resolver, in order of preference. Supported values are "udp", "tcp",
+	// "tls", "https" and "quic". If empty, "udp" is used for backwards
+	// compatibility.
+	ResolverProtocols []string `toml:"resolver_protocols"`
+	// InsecureSkipVerify disables TLS certificate verification for DoT/DoH/DoQ
+	// resolvers. This is only intended for pinned resolvers learned insecurely
+	// (e.g. from DHCP) and verified via SPKIPins instead.
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+	// SPKIPins is a list of hex-encoded SHA-256 SPKI fingerprints. When
+	// non-empty, a resolver's leaf certificate must match one of these pins
+	// for the TLS-based protocols (tls, https, quic).
+	SPKIPins []string `toml:"spki_pins"`
+	// PreferIPv4 selects addrselect.IPv4PreferredPolicyTable instead of the
+	// RFC 6724 default, for operators who want IPv4 hints tried before IPv6
+	// regardless of the destination's scope.
+	PreferIPv4 bool `toml:"prefer_ipv4"`
+}
+
+// resolverEndpoint describes how to reach a single resolver: which transport
+// protocol to use and the address/URL to dial.
+type resolverEndpoint struct {
+	protocol string
+	addr     string
+}
+
+// parseResolver interprets a resolver string from the configuration. Bare
+// host[:port] strings use the generator's default ResolverProtocols chain;
+// a "scheme://" prefix (https://, quic://, tls://) pins that resolver to a
+// single protocol, overriding the default chain.
+func parseResolver(resolver string, defaultProtocols []string) []resolverEndpoint {
+	switch {
+	case strings.HasPrefix(resolver, "https://"):
+		return []resolverEndpoint{{protocol: resolverProtoHTTPS, addr: resolver}}
+	case strings.HasPrefix(resolver, "quic://"):
+		return []resolverEndpoint{{protocol: resolverProtoQUIC, addr: strings.TrimPrefix(resolver, "quic://")}}
+	case strings.HasPrefix(resolver, "tls://"):
+		return []resolverEndpoint{{protocol: resolverProtoTLS, addr: strings.TrimPrefix(resolver, "tls://")}}
+	default:
+		protocols := defaultProtocols
+		if len(protocols) == 0 {
+			protocols = []string{resolverProtoUDP}
+		}
+		endpoints := make([]resolverEndpoint, 0, len(protocols))
+		for _, proto := range protocols {
+			endpoints = append(endpoints, resolverEndpoint{protocol: proto, addr: resolver})
+		}
+		return endpoints
+	}
 }
 
 var _ HintGenerator = (*DNSSDHintGenerator)(nil)
 
 // DNSSDHintGenerator implements the Domain Name System Service Discovery
 type DNSSDHintGenerator struct {
-	cfg *DNSHintGeneratorConf
+	cfg   *DNSHintGeneratorConf
+	iface *net.Interface
 }
 
-func NewDNSSDHintGenerator(cfg *DNSHintGeneratorConf) *DNSSDHintGenerator {
-	return &DNSSDHintGenerator{cfg}
+func NewDNSSDHintGenerator(cfg *DNSHintGeneratorConf, iface *net.Interface) *DNSSDHintGenerator {
+	return &DNSSDHintGenerator{cfg, iface}
 }
 
 func (g *DNSSDHintGenerator) Generate(ipHintsChan chan<- net.IP) {
@@ -67,15 +142,15 @@ func (g *DNSSDHintGenerator) Generate(ipHintsChan chan<- net.IP) {
 			for _, domain := range dnsServer.searchDomains {
 				if g.cfg.EnableSRV {
 					query := getDNSSDQuery(resolver, domain)
-					resolveDNS(resolver, query, dns.TypeSRV, ipHintsChan)
+					g.resolveAndEmit(resolver, query, dns.TypeSRV, ipHintsChan)
 				}
 				if g.cfg.EnableSD {
 					query := getDNSSDQuery(resolver, domain)
-					resolveDNS(resolver, query, dns.TypePTR, ipHintsChan)
+					g.resolveAndEmit(resolver, query, dns.TypePTR, ipHintsChan)
 				}
 				if g.cfg.EnableNAPTR {
 					query := getDNSNAPTRQuery(resolver, domain)
-					resolveDNS(resolver, query, dns.TypeNAPTR, ipHintsChan)
+					g.resolveAndEmit(resolver, query, dns.TypeNAPTR, ipHintsChan)
 				}
 			}
 		}
@@ -83,6 +158,55 @@ func (g *DNSSDHintGenerator) Generate(ipHintsChan chan<- net.IP) {
 	log.Info("DNS hinting done")
 }
 
+// resolveAndEmit resolves query and, once the whole SRV/NAPTR/PTR
+// resolution round it triggers has collected every A/AAAA hint, orders
+// them per RFC 6724 (see hinting/addrselect) and emits them onto
+// ipHintsChan in that order. This avoids handing out an IPv6 hint the
+// local interface can't actually reach just because it happened to arrive
+// first.
+func (g *DNSSDHintGenerator) resolveAndEmit(resolver, query string, dnsRR uint16, ipHintsChan chan<- net.IP) {
+	var collected []net.IP
+	g.resolveDNS(resolver, query, dnsRR, &collected)
+	g.sortByRFC6724(collected)
+	for _, ip := range collected {
+		ipHintsChan <- ip
+	}
+}
+
+// sortByRFC6724 orders ips in place, best destination first, using the
+// addresses assigned to g.iface as the candidate source addresses.
+func (g *DNSSDHintGenerator) sortByRFC6724(ips []net.IP) {
+	if len(ips) < 2 {
+		return
+	}
+	var ifaceAddrs []net.IP
+	if g.iface != nil {
+		addrs, err := g.iface.Addrs()
+		if err != nil {
+			log.Error("Error reading interface addresses for RFC 6724 sorting", "err", err)
+		} else {
+			for _, a := range addrs {
+				if ipNet, ok := a.(*net.IPNet); ok {
+					ifaceAddrs = append(ifaceAddrs, ipNet.IP)
+				}
+			}
+		}
+	}
+	candidates := make([]addrselect.Candidate, len(ips))
+	for i, ip := range ips {
+		src, _ := addrselect.ChooseSourceAddr(ip, ifaceAddrs)
+		candidates[i] = addrselect.Candidate{Dst: ip, Src: src}
+	}
+	table := addrselect.DefaultPolicyTable
+	if g.cfg.PreferIPv4 {
+		table = addrselect.IPv4PreferredPolicyTable
+	}
+	addrselect.Sort(candidates, table)
+	for i, c := range candidates {
+		ips[i] = c.Dst
+	}
+}
+
 type DNSInfo struct {
 	resolvers     []string
 	searchDomains []string
@@ -101,13 +225,29 @@ func getDNSNAPTRQuery(resolver, domain string) string {
 	return query
 }
 
-func resolveDNS(resolver, query string, dnsRR uint16, ipHintsChan chan<- net.IP) {
+// resolveDNS sends query/dnsRR to resolver and appends any A/AAAA hints
+// found (directly or transitively via SRV/NAPTR/PTR chasing) to *collected.
+// The resolver is tried over each protocol in g.cfg.ResolverProtocols in
+// order, falling back to the next one on error, so a misconfigured or
+// blocked transport still lets the bootstrapper make progress.
+func (g *DNSSDHintGenerator) resolveDNS(resolver, query string, dnsRR uint16, collected *[]net.IP) {
+	endpoints := parseResolver(resolver, g.cfg.ResolverProtocols)
 	msg := new(dns.Msg)
 	msg.SetQuestion(query, dnsRR)
 	msg.RecursionDesired = true
-	result, err := dns.Exchange(msg, resolver+":53")
+
+	var result *dns.Msg
+	var err error
+	for _, endpoint := range endpoints {
+		result, err = g.exchange(endpoint, msg)
+		if err == nil {
+			break
+		}
+		log.Error("DNS query failed, trying next protocol",
+			"resolver", resolver, "protocol", endpoint.protocol, "err", err)
+	}
 	if err != nil {
-		log.Error("DNS-SD failed", "err", err)
+		log.Error("DNS-SD failed", "resolver", resolver, "err", err)
 		return
 	}
 
@@ -118,7 +258,7 @@ func resolveDNS(resolver, query string, dnsRR uint16, ipHintsChan chan<- net.IP)
 		switch answer.(type) {
 		case *dns.PTR:
 			result := *(answer.(*dns.PTR))
-			resolveDNS(resolver, result.Ptr, dns.TypeSRV, ipHintsChan)
+			g.resolveDNS(resolver, result.Ptr, dns.TypeSRV, collected)
 		case *dns.NAPTR:
 			result := *(answer.(*dns.NAPTR))
 			if result.Service == discoveryDDDSDNSName {
@@ -135,11 +275,11 @@ func resolveDNS(resolver, query string, dnsRR uint16, ipHintsChan chan<- net.IP)
 		case *dns.A:
 			result := *(answer.(*dns.A))
 			log.Info("DNS hint", "IP", result.A.String())
-			ipHintsChan <- result.A
+			*collected = append(*collected, result.A)
 		case *dns.AAAA:
 			result := *(answer.(*dns.AAAA))
 			log.Info("DNS hint", "IP", result.AAAA.String())
-			ipHintsChan <- result.AAAA
+			*collected = append(*collected, result.AAAA)
 		}
 	}
 
@@ -147,8 +287,8 @@ func resolveDNS(resolver, query string, dnsRR uint16, ipHintsChan chan<- net.IP)
 		sort.Sort(byPriority(serviceRecords))
 
 		for _, answer := range serviceRecords {
-			resolveDNS(resolver, answer.Target, dns.TypeAAAA, ipHintsChan)
-			resolveDNS(resolver, answer.Target, dns.TypeA, ipHintsChan)
+			g.resolveDNS(resolver, answer.Target, dns.TypeAAAA, collected)
+			g.resolveDNS(resolver, answer.Target, dns.TypeA, collected)
 		}
 	}
 
@@ -158,17 +298,140 @@ func resolveDNS(resolver, query string, dnsRR uint16, ipHintsChan chan<- net.IP)
 		for _, answer := range naptrRecords {
 			switch answer.Flags {
 			case "":
-				resolveDNS(resolver, answer.Replacement, dns.TypeNAPTR, ipHintsChan)
+				g.resolveDNS(resolver, answer.Replacement, dns.TypeNAPTR, collected)
 			case "A":
-				resolveDNS(resolver, answer.Replacement, dns.TypeAAAA, ipHintsChan)
-				resolveDNS(resolver, answer.Replacement, dns.TypeA, ipHintsChan)
+				g.resolveDNS(resolver, answer.Replacement, dns.TypeAAAA, collected)
+				g.resolveDNS(resolver, answer.Replacement, dns.TypeA, collected)
 			case "S":
-				resolveDNS(resolver, answer.Replacement, dns.TypeSRV, ipHintsChan)
+				g.resolveDNS(resolver, answer.Replacement, dns.TypeSRV, collected)
 			}
 		}
 	}
 }
 
+// exchange performs a single DNS query over endpoint's transport protocol.
+func (g *DNSSDHintGenerator) exchange(endpoint resolverEndpoint, msg *dns.Msg) (*dns.Msg, error) {
+	switch endpoint.protocol {
+	case resolverProtoUDP, "":
+		result, _, err := (&dns.Client{Net: ""}).Exchange(msg, withDefaultPort(endpoint.addr, "53"))
+		return result, err
+	case resolverProtoTCP:
+		result, _, err := (&dns.Client{Net: "tcp"}).Exchange(msg, withDefaultPort(endpoint.addr, "53"))
+		return result, err
+	case resolverProtoTLS:
+		addr := withDefaultPort(endpoint.addr, "853")
+		client := &dns.Client{Net: "tcp-tls", TLSConfig: g.tlsConfig()}
+		result, _, err := client.Exchange(msg, addr)
+		return result, err
+	case resolverProtoHTTPS:
+		return g.exchangeDoH(endpoint.addr, msg)
+	case resolverProtoQUIC:
+		return g.exchangeDoQ(endpoint.addr, msg)
+	default:
+		return nil, common.NewBasicError("unsupported resolver protocol", nil, "protocol", endpoint.protocol)
+	}
+}
+
+// withDefaultPort returns addr unchanged if it already carries a port, and
+// otherwise addr joined with port (bracketing a bare IPv6 literal).
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// tlsConfig builds the tls.Config used for DoT/DoH/DoQ resolvers, wiring up
+// SPKI pin verification for resolvers learned insecurely (e.g. from DHCP).
+func (g *DNSSDHintGenerator) tlsConfig() *tls.Config {
+	cfg := &tls.Config{InsecureSkipVerify: g.cfg.InsecureSkipVerify}
+	if len(g.cfg.SPKIPins) > 0 {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = spkipin.Verify(g.cfg.SPKIPins)
+	}
+	return cfg
+}
+
+func (g *DNSSDHintGenerator) exchangeDoH(url string, msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, common.NewBasicError("failed to pack DNS message for DoH", err)
+	}
+	ctx, cancelF := context.WithTimeout(context.Background(), doqQueryTimeout)
+	defer cancelF()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, common.NewBasicError("failed to build DoH request", err)
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: g.tlsConfig()}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, common.NewBasicError("DoH request failed", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, common.NewBasicError("DoH request failed", nil, "status", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, common.NewBasicError("failed to read DoH response", err)
+	}
+	result := new(dns.Msg)
+	if err := result.Unpack(body); err != nil {
+		return nil, common.NewBasicError("failed to unpack DoH response", err)
+	}
+	return result, nil
+}
+
+func (g *DNSSDHintGenerator) exchangeDoQ(addr string, msg *dns.Msg) (*dns.Msg, error) {
+	addr = withDefaultPort(addr, "853")
+	ctx, cancelF := context.WithTimeout(context.Background(), doqQueryTimeout)
+	defer cancelF()
+	tlsConf := g.tlsConfig().Clone()
+	tlsConf.NextProtos = []string{doqALPN}
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, nil)
+	if err != nil {
+		return nil, common.NewBasicError("DoQ dial failed", err)
+	}
+	defer conn.CloseWithError(0, "")
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, common.NewBasicError("DoQ stream open failed", err)
+	}
+	defer stream.Close()
+	// RFC 9250 requires the message ID to be set to 0 on the wire.
+	wireMsg := msg.Copy()
+	wireMsg.Id = 0
+	packed, err := wireMsg.Pack()
+	if err != nil {
+		return nil, common.NewBasicError("failed to pack DNS message for DoQ", err)
+	}
+	// RFC 9250 frames each message with a 2-octet length prefix, as DNS
+	// over TCP does.
+	framed := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(framed, uint16(len(packed)))
+	copy(framed[2:], packed)
+	if _, err := stream.Write(framed); err != nil {
+		return nil, common.NewBasicError("DoQ write failed", err)
+	}
+	stream.Close()
+	raw, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, common.NewBasicError("DoQ read failed", err)
+	}
+	if len(raw) < 2 || len(raw)-2 < int(binary.BigEndian.Uint16(raw)) {
+		return nil, common.NewBasicError("truncated DoQ response", nil)
+	}
+	result := new(dns.Msg)
+	if err := result.Unpack(raw[2 : 2+int(binary.BigEndian.Uint16(raw))]); err != nil {
+		return nil, common.NewBasicError("failed to unpack DoQ response", err)
+	}
+	result.Id = msg.Id
+	return result, nil
+}
+
 func getDomainName() (string, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
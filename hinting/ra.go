@@ -0,0 +1,182 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hinting
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/log"
+)
+
+const (
+	icmpv6RouterAdvertisement = 134
+	allRoutersMulticastAddr   = "ff02::2"
+
+	// RA option types, RFC 4861 section 4.6 and RFC 8106 section 5.
+	raOptRDNSS = 25
+	raOptDNSSL = 31
+)
+
+// RAHintGeneratorConf configures the Router Advertisement hint generator.
+type RAHintGeneratorConf struct {
+	Enable bool `toml:"enable"`
+}
+
+// RAHintGenerator listens for IPv6 Router Advertisements and extracts RDNSS
+// (Recursive DNS Server) and DNSSL (DNS Search List) options per RFC 8106,
+// feeding them into dnsServersChan for the DNS-SD hint path. This seeds
+// DNS-SD on v6-only, SLAAC-only networks where no DHCPv6 server hands out a
+// resolver.
+//
+// RAHintGenerator does not implement HintGenerator: it never produces an
+// IP hint directly, only DNS resolver/search-domain information, so it is
+// started independently of the hintGenerators race rather than through
+// that interface.
+type RAHintGenerator struct {
+	cfg   *RAHintGeneratorConf
+	iface *net.Interface
+}
+
+func NewRAHintGenerator(cfg *RAHintGeneratorConf, iface *net.Interface) *RAHintGenerator {
+	return &RAHintGenerator{cfg, iface}
+}
+
+func (g *RAHintGenerator) Generate() {
+	if !g.cfg.Enable {
+		return
+	}
+	// A raw ICMPv6 socket is needed: a non-privileged "udp6" ICMP socket
+	// only receives echo replies, never Router Advertisements.
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		log.Error("Opening ICMPv6 socket for RA listening failed", "err", err)
+		return
+	}
+	defer conn.Close()
+	pconn := conn.IPv6PacketConn()
+	group := net.ParseIP(allRoutersMulticastAddr)
+	if err := pconn.JoinGroup(g.iface, &net.UDPAddr{IP: group}); err != nil {
+		log.Error("Joining all-routers multicast group failed", "err", err)
+		return
+	}
+	var f ipv6.ICMPFilter
+	f.SetAll(true)
+	f.Accept(ipv6.ICMPTypeRouterAdvertisement)
+	if err := pconn.SetICMPFilter(&f); err != nil {
+		log.Error("Setting ICMPv6 filter failed", "err", err)
+		return
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, _, err := pconn.ReadFrom(buf)
+		if err != nil {
+			// A read error (e.g. a transient ICMP error reported back on the
+			// socket) shouldn't permanently disable the RA listener for the
+			// rest of the process, just like a malformed packet doesn't.
+			log.Error("Reading RA packet failed, retrying", "err", err)
+			continue
+		}
+		info, err := parseRA(buf[:n])
+		if err != nil {
+			log.Error("Ignoring malformed RA packet", "err", err)
+			continue
+		}
+		if info == nil {
+			continue
+		}
+		dnsServersChan <- *info
+	}
+}
+
+// raHeaderLen is the fixed ICMPv6 Router Advertisement header: type, code,
+// checksum, cur hop limit, flags, router lifetime, reachable time, retrans
+// timer.
+const raHeaderLen = 16
+
+func parseRA(msg []byte) (*DNSInfo, error) {
+	if len(msg) < raHeaderLen {
+		return nil, common.NewBasicError("RA packet shorter than fixed header", nil)
+	}
+	options := msg[raHeaderLen:]
+	var info DNSInfo
+	found := false
+	for len(options) >= 8 {
+		optType := options[0]
+		optLenWords := int(options[1])
+		if optLenWords == 0 {
+			return nil, common.NewBasicError("RA option with zero length", nil)
+		}
+		optLen := optLenWords * 8
+		if len(options) < optLen {
+			return nil, common.NewBasicError("truncated RA option", nil)
+		}
+		data := options[2:optLen]
+		switch optType {
+		case raOptRDNSS:
+			// RFC 8106 section 5.1: reserved(2) + lifetime(4) + addresses(16 each).
+			if len(data) >= 6 {
+				for off := 6; off+16 <= len(data); off += 16 {
+					info.resolvers = append(info.resolvers, net.IP(data[off:off+16]).String())
+					found = true
+				}
+			}
+		case raOptDNSSL:
+			// RFC 8106 section 5.2: reserved(2) + lifetime(4) + DNS search list
+			// encoded as RFC 1035 4.1.4 labels.
+			if len(data) >= 6 {
+				for _, domain := range decodeDNSSL(data[6:]) {
+					info.searchDomains = append(info.searchDomains, domain)
+					found = true
+				}
+			}
+		}
+		options = options[optLen:]
+	}
+	if !found {
+		return nil, nil
+	}
+	return &info, nil
+}
+
+// decodeDNSSL decodes a sequence of RFC 1035-encoded domain names as used
+// by the DNSSL option. Names are returned without a trailing dot, the form
+// the DNS-SD query builders expect for search domains.
+func decodeDNSSL(data []byte) []string {
+	var domains []string
+	var labels []string
+	for len(data) > 0 {
+		labelLen := int(data[0])
+		data = data[1:]
+		if labelLen == 0 {
+			if len(labels) > 0 {
+				domains = append(domains, strings.Join(labels, "."))
+				labels = nil
+			}
+			continue
+		}
+		if labelLen > len(data) {
+			break
+		}
+		labels = append(labels, string(data[:labelLen]))
+		data = data[labelLen:]
+	}
+	return domains
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hinting
+
+import "net"
+
+// SignedHint is a discovery server hint that may carry proof it was not
+// injected by an on-path attacker, e.g. an Ed25519 signature over the FQDN
+// it was resolved from. Verified is false for hints whose source cannot
+// prove authenticity (e.g. DHCPv6 without a valid signature); the main
+// bootstrapping loop should prefer Verified hints when both are available.
+type SignedHint struct {
+	Addr     net.TCPAddr
+	Verified bool
+}
+
+// SignedHintGenerator is implemented by hint sources that can attest to the
+// authenticity of the hints they produce. Unlike HintGenerator, it pushes
+// SignedHint values rather than bare net.TCPAddr, so the main race loop can
+// tell verified hints apart from unverified ones.
+type SignedHintGenerator interface {
+	Generate(signedHintsChan chan<- SignedHint)
+}
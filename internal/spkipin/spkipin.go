@@ -0,0 +1,53 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package spkipin implements SPKI (Subject Public Key Info) SHA-256
+// fingerprint pinning, shared by the bootstrap-time TLS clients (the
+// discovery HTTPS client and the DoT/DoH/DoQ DNS resolvers) that may have
+// to trust a server certificate learned insecurely (e.g. via DHCP or DNS)
+// instead of through the usual CA chain.
+package spkipin
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Verify returns a tls.Config.VerifyPeerCertificate callback that accepts
+// the connection if the leaf certificate's SHA-256 SPKI fingerprint
+// matches one of pins (hex-encoded, case-insensitive). Only the leaf is
+// checked, as it is the only presented certificate whose key the handshake
+// proves the peer holds.
+func Verify(pins []string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no certificate presented")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("parsing leaf certificate: %v", err)
+		}
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		fingerprint := hex.EncodeToString(sum[:])
+		for _, pin := range pins {
+			if strings.EqualFold(fingerprint, pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("leaf certificate did not match a pinned SPKI fingerprint")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package trust verifies the TRCs fetched during bootstrap against an
+// operator-supplied trust anchor, so the bootstrapper moves from
+// trust-on-first-use to cryptographically authenticated bootstrap.
+package trust
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/scrypto/cppki"
+)
+
+// AnchorConf configures the trust anchor used to verify TRCs fetched from a
+// discovery server. Exactly one of TRCFile or Fingerprints should normally
+// be set; if both are set, a TRC is accepted if it satisfies either.
+type AnchorConf struct {
+	// TRCFile is the path to a pinned TRC that the fetched TRC chain must
+	// build on.
+	TRCFile string `toml:"trc_file"`
+	// Fingerprints is a list of hex-encoded SHA-256 fingerprints of trusted
+	// TRCs, for deployments that pin by hash rather than by a base TRC file.
+	Fingerprints []string `toml:"fingerprints"`
+}
+
+// Verifier verifies a set of TRC files against an AnchorConf.
+type Verifier struct {
+	cfg AnchorConf
+}
+
+// NewVerifier builds a Verifier from cfg.
+func NewVerifier(cfg AnchorConf) *Verifier {
+	return &Verifier{cfg: cfg}
+}
+
+// VerifyTRCs loads every *.trc file in dir, orders them by ISD, base and
+// serial number, and verifies the resulting chain against the configured
+// trust anchor. It returns the validated TRCs in verification order, or an
+// error if any TRC fails to parse or the chain does not validate.
+func (v *Verifier) VerifyTRCs(dir string) ([]cppki.TRC, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, common.NewBasicError("listing extracted TRCs", err)
+	}
+	var trcs []cppki.TRC
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".trc" {
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, common.NewBasicError("reading TRC", err, "file", entry.Name())
+		}
+		decoded, err := cppki.DecodeSignedTRC(raw)
+		if err != nil {
+			return nil, common.NewBasicError("decoding TRC", err, "file", entry.Name())
+		}
+		trcs = append(trcs, decoded.TRC)
+	}
+	if len(trcs) == 0 {
+		return nil, common.NewBasicError("no TRCs found in archive", nil, "dir", dir)
+	}
+	sort.Slice(trcs, func(i, j int) bool {
+		if trcs[i].ID.ISD != trcs[j].ID.ISD {
+			return trcs[i].ID.ISD < trcs[j].ID.ISD
+		}
+		if trcs[i].ID.Base != trcs[j].ID.Base {
+			return trcs[i].ID.Base < trcs[j].ID.Base
+		}
+		return trcs[i].ID.Serial < trcs[j].ID.Serial
+	})
+	if err := v.verifyChain(trcs); err != nil {
+		return nil, err
+	}
+	return trcs, nil
+}
+
+// verifyChain checks that the first TRC in the (sorted) chain is trusted
+// per v.cfg, and that each subsequent TRC in the same ISD is signed by a
+// quorum of voters from its predecessor.
+func (v *Verifier) verifyChain(trcs []cppki.TRC) error {
+	anchor, err := v.trustAnchor()
+	if err != nil {
+		return err
+	}
+	root := trcs[0]
+	if !v.isTrusted(root, anchor) {
+		return common.NewBasicError("base TRC is not trusted by the configured anchor", nil,
+			"isd", root.ID.ISD, "base", root.ID.Base, "serial", root.ID.Serial)
+	}
+	prev := root
+	for _, trc := range trcs[1:] {
+		if trc.ID.ISD != prev.ID.ISD {
+			prev = trc
+			if !v.isTrusted(trc, anchor) {
+				return common.NewBasicError("TRC is not trusted by the configured anchor", nil,
+					"isd", trc.ID.ISD, "base", trc.ID.Base, "serial", trc.ID.Serial)
+			}
+			continue
+		}
+		if err := prev.UpdateVerify(&trc); err != nil {
+			return common.NewBasicError("TRC update verification failed", err,
+				"isd", trc.ID.ISD, "from_serial", prev.ID.Serial, "to_serial", trc.ID.Serial)
+		}
+		prev = trc
+	}
+	return nil
+}
+
+func (v *Verifier) trustAnchor() (*cppki.TRC, error) {
+	if v.cfg.TRCFile == "" {
+		return nil, nil
+	}
+	raw, err := ioutil.ReadFile(v.cfg.TRCFile)
+	if err != nil {
+		return nil, common.NewBasicError("reading trust anchor TRC", err, "file", v.cfg.TRCFile)
+	}
+	decoded, err := cppki.DecodeSignedTRC(raw)
+	if err != nil {
+		return nil, common.NewBasicError("decoding trust anchor TRC", err, "file", v.cfg.TRCFile)
+	}
+	return &decoded.TRC, nil
+}
+
+// isTrusted reports whether trc matches the pinned anchor TRC or one of the
+// pinned fingerprints.
+func (v *Verifier) isTrusted(trc cppki.TRC, anchor *cppki.TRC) bool {
+	// ID alone is just the (ISD, Base, Serial) tuple, not a cryptographic
+	// property: a forged TRC could trivially claim the anchor's ID, so the
+	// anchor path must also compare the signed content, the same way the
+	// Fingerprints path below compares a hash of it.
+	if anchor != nil && trc.ID == anchor.ID && bytes.Equal(trc.Raw, anchor.Raw) {
+		return true
+	}
+	if len(v.cfg.Fingerprints) == 0 {
+		return false
+	}
+	sum := sha256.Sum256(trc.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	for _, pin := range v.cfg.Fingerprints {
+		if fingerprint == pin {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyTopologyIA checks that ia is covered by one of the validated trcs,
+// i.e. that ia's ISD matches a TRC in the chain.
+func VerifyTopologyIA(ia addr.IA, trcs []cppki.TRC) error {
+	for _, trc := range trcs {
+		if trc.ID.ISD == ia.ISD() {
+			return nil
+		}
+	}
+	return common.NewBasicError("topology ISD-AS is not covered by any validated TRC", nil, "ia", ia)
+}
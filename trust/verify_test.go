@@ -0,0 +1,112 @@
+// Copyright 2021 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trust
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/scrypto"
+	"github.com/scionproto/scion/go/lib/scrypto/cppki"
+)
+
+func trcWithRaw(isd addr.ISD, base, serial scrypto.Version, raw string) cppki.TRC {
+	return cppki.TRC{
+		ID:  cppki.TRCID{ISD: isd, Base: base, Serial: serial},
+		Raw: []byte(raw),
+	}
+}
+
+func fingerprintOf(trc cppki.TRC) string {
+	sum := sha256.Sum256(trc.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// TestVerifyChainAcceptsMixedISDs covers a chain spanning more than one ISD:
+// each ISD's first TRC only needs to be individually trusted by the anchor,
+// since UpdateVerify chaining only applies within a single ISD.
+func TestVerifyChainAcceptsMixedISDs(t *testing.T) {
+	isd1Base := trcWithRaw(1, 1, 1, "isd1-base")
+	isd2Base := trcWithRaw(2, 1, 1, "isd2-base")
+	v := &Verifier{cfg: AnchorConf{
+		Fingerprints: []string{fingerprintOf(isd1Base), fingerprintOf(isd2Base)},
+	}}
+
+	err := v.verifyChain([]cppki.TRC{isd1Base, isd2Base})
+	assert.NoError(t, err)
+}
+
+// TestVerifyChainFailsOnBadUpdate covers a same-ISD chain whose second TRC
+// does not validly update the first: verifyChain must reject it rather than
+// silently accepting the later serial.
+func TestVerifyChainFailsOnBadUpdate(t *testing.T) {
+	base := trcWithRaw(1, 1, 1, "isd1-base")
+	unrelatedUpdate := trcWithRaw(1, 1, 2, "isd1-serial-2-unsigned-by-base")
+	v := &Verifier{cfg: AnchorConf{Fingerprints: []string{fingerprintOf(base)}}}
+
+	err := v.verifyChain([]cppki.TRC{base, unrelatedUpdate})
+	assert.Error(t, err)
+}
+
+// TestIsTrustedFingerprintsVsTRCFile covers the two ways an anchor can be
+// pinned: by TRCFile (matched via the decoded anchor TRC's ID and raw bytes)
+// and by an explicit Fingerprints list (matched via a hash of the candidate
+// TRC's raw bytes).
+func TestIsTrustedFingerprintsVsTRCFile(t *testing.T) {
+	trc := trcWithRaw(1, 1, 1, "pinned-trc")
+
+	t.Run("matches via anchor TRC ID and content", func(t *testing.T) {
+		v := &Verifier{}
+		anchor := trc
+		assert.True(t, v.isTrusted(trc, &anchor))
+	})
+
+	t.Run("forged TRC with the anchor's ID but different content is rejected", func(t *testing.T) {
+		v := &Verifier{}
+		anchor := trcWithRaw(1, 1, 1, "pinned-trc")
+		forged := trcWithRaw(1, 1, 1, "forged-trc-same-id")
+		assert.False(t, v.isTrusted(forged, &anchor))
+	})
+
+	t.Run("matches via fingerprint", func(t *testing.T) {
+		v := &Verifier{cfg: AnchorConf{Fingerprints: []string{fingerprintOf(trc)}}}
+		assert.True(t, v.isTrusted(trc, nil))
+	})
+
+	t.Run("fingerprint mismatch is rejected", func(t *testing.T) {
+		v := &Verifier{cfg: AnchorConf{Fingerprints: []string{"deadbeef"}}}
+		assert.False(t, v.isTrusted(trc, nil))
+	})
+}
+
+// TestIsTrustedAllFieldsUnsetRejectsEverything documents, rather than just
+// exercises, the fail-closed behavior of an unconfigured trust anchor: a
+// Verifier built from a zero-value AnchorConf (TRCFile and Fingerprints both
+// unset, as happens if an operator forgets to configure TrustAnchor) must
+// trust nothing, so bootstrap fails loudly instead of installing an
+// unverified TRC chain.
+func TestIsTrustedAllFieldsUnsetRejectsEverything(t *testing.T) {
+	v := &Verifier{}
+	trc := trcWithRaw(1, 1, 1, "anything")
+
+	assert.False(t, v.isTrusted(trc, nil))
+
+	err := v.verifyChain([]cppki.TRC{trc})
+	assert.Error(t, err, "an unconfigured trust anchor must reject every TRC, not trust-on-first-use")
+}